@@ -2,34 +2,373 @@ package qflow
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/threecommaio/qflow/pkg/durable"
+	"golang.org/x/time/rate"
 )
 
+const (
+	hostStateClosed = iota
+	hostStateHalfOpen
+	hostStateOpen
+)
+
+const (
+	defaultFailureThreshold   = 5
+	defaultCooldownWindow     = 30 * time.Second
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+const (
+	failurePolicyFailFast = "fail-fast"
+	failurePolicyHold     = "hold"
+)
+
+const (
+	routingFanout = "fanout"
+	routingHost   = "host"
+)
+
+// matchRule is a single routing predicate for the "host" routing mode. A
+// rule matches a request when every non-empty field it declares matches.
+type matchRule struct {
+	HostGlob    string
+	PathPrefix  string
+	Header      string
+	HeaderValue string
+}
+
+// matches reports whether req satisfies every non-empty predicate in r.
+func (r matchRule) matches(req *http.Request) bool {
+	if r.HostGlob != "" {
+		ok, err := path.Match(r.HostGlob, requestHostname(req))
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+
+	if r.Header != "" && req.Header.Get(r.Header) != r.HeaderValue {
+		return false
+	}
+
+	return true
+}
+
+// requestHostname returns req.Host with any port stripped, so a HostGlob
+// of "example.com" still matches a request for "example.com:8443".
+func requestHostname(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+// HealthCheckConfig configures active probing of an endpoint's hosts.
+type HealthCheckConfig struct {
+	Path           string
+	Method         string
+	Interval       time.Duration
+	ConnectTimeout time.Duration
+	ExpectedStatus []int
+	FailurePolicy  string
+}
+
+// accepts reports whether status is one of the configured acceptable codes,
+// defaulting to a plain 200 when none are configured.
+func (h HealthCheckConfig) accepts(status int) bool {
+	if len(h.ExpectedStatus) == 0 {
+		return status == http.StatusOK
+	}
+	for _, s := range h.ExpectedStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportConfig configures the outbound http.Transport used to reach an
+// endpoint's hosts.
+type TransportConfig struct {
+	RootCAFile          string
+	ClientCertFile      string
+	ClientKeyFile       string
+	InsecureSkipVerify  bool
+	DisableHTTP2        bool
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+}
+
+// buildTransport constructs an *http.Transport dedicated to a single
+// endpoint, so opting into InsecureSkipVerify or a custom root CA never
+// leaks into any other endpoint's outbound calls.
+func buildTransport(cfg TransportConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.RootCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading root ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" && cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	keepAlive := cfg.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+		// a custom DialContext/TLSClientConfig otherwise turns HTTP/2 off
+		ForceAttemptHTTP2: !cfg.DisableHTTP2,
+	}
+
+	if cfg.DisableHTTP2 {
+		// an empty, non-nil map disables the transport's automatic HTTP/2 upgrade
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return transport, nil
+}
+
+// ListenerConfig describes a single address qflow should bind, with its own
+// optional TLS termination and metrics-only restriction.
+type ListenerConfig struct {
+	Addr        string
+	MetricsOnly bool
+	TLSConfig   *tls.Config
+}
+
+// buildListenerConfigs translates the configured Config.HTTP.Listeners into
+// ListenerConfigs, falling back to a single plaintext listener on addr when
+// none are configured.
+func buildListenerConfigs(config *Config, addr string) ([]ListenerConfig, error) {
+	if len(config.HTTP.Listeners) == 0 {
+		return []ListenerConfig{{Addr: addr}}, nil
+	}
+
+	listeners := make([]ListenerConfig, 0, len(config.HTTP.Listeners))
+	for _, l := range config.HTTP.Listeners {
+		lc := ListenerConfig{Addr: l.Addr, MetricsOnly: l.MetricsOnly}
+
+		if l.TLS.CertFile != "" || l.TLS.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading tls cert for listener %s: %w", l.Addr, err)
+			}
+
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+			if l.TLS.ClientCAFile != "" {
+				pem, err := ioutil.ReadFile(l.TLS.ClientCAFile)
+				if err != nil {
+					return nil, fmt.Errorf("reading client ca file for listener %s: %w", l.Addr, err)
+				}
+				pool := x509.NewCertPool()
+				pool.AppendCertsFromPEM(pem)
+				tlsConfig.ClientCAs = pool
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			lc.TLSConfig = tlsConfig
+		}
+
+		listeners = append(listeners, lc)
+	}
+
+	return listeners, nil
+}
+
+// hostState tracks the circuit breaker state for a single host within an
+// endpoint's pool.
+type hostState struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	state               int
+	openUntil           time.Time
+}
+
+// isAvailable reports whether the host may be used for the next attempt,
+// flipping an open circuit to half-open once its cooldown has elapsed.
+func (h *hostState) isAvailable(endpoint, host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != hostStateOpen {
+		return true
+	}
+
+	if time.Now().After(h.openUntil) {
+		h.state = hostStateHalfOpen
+		endpointHostState.WithLabelValues(endpoint, host).Set(hostStateHalfOpen)
+		return true
+	}
+
+	return false
+}
+
+// recordSuccess closes the circuit and resets the failure count.
+func (h *hostState) recordSuccess(endpoint, host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != hostStateClosed {
+		log.Infof("endpoint (%s) host [%s] recovered, closing circuit", endpoint, host)
+	}
+
+	h.consecutiveFailures = 0
+	h.state = hostStateClosed
+	endpointHostState.WithLabelValues(endpoint, host).Set(hostStateClosed)
+}
+
+// recordFailure increments the failure count and trips the circuit open
+// once threshold is reached, or immediately if a half-open probe failed.
+func (h *hostState) recordFailure(endpoint, host string, threshold int, cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFailures++
+
+	if h.state == hostStateHalfOpen || h.consecutiveFailures >= threshold {
+		h.state = hostStateOpen
+		h.openUntil = time.Now().Add(cooldown)
+		log.Infof("endpoint (%s) host [%s] tripped circuit breaker after %d consecutive failures",
+			endpoint, host, h.consecutiveFailures)
+		endpointHostState.WithLabelValues(endpoint, host).Set(hostStateOpen)
+		return
+	}
+}
+
+// backoffDelay returns an exponentially increasing delay with jitter for
+// the given attempt number (0-indexed).
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	d := base * time.Duration(int64(1)<<uint(attempt))
+	jitter := time.Duration(rand.Int63n(int64(base) + 1))
+	return d + jitter
+}
+
 type Endpoint struct {
 	Name           string
 	Hosts          []string
+	HostStates     []*hostState
+	Healthy        []*int32
 	Writer         chan interface{}
 	DurableChannel chan interface{}
 	WorkerChannel  chan *durable.Request
 	Timeout        time.Duration
+
+	Retries          int
+	Delay            time.Duration
+	FailureThreshold int
+	CooldownWindow   time.Duration
+
+	HealthCheck HealthCheckConfig
+	Matches     []matchRule
+	Limiter     *rate.Limiter
+	Transport   *http.Transport
+
+	// Done is closed to signal HTTPWorker, ReadDiskChannel, and
+	// HealthChecker to drain and return during a graceful shutdown.
+	Done chan struct{}
+	WG   *sync.WaitGroup
 }
 
 type Handler struct {
-	Endpoints []Endpoint
+	Endpoints      []Endpoint
+	Routing        string
+	InboundLimiter *rate.Limiter
+	HighWaterMark  int
+
+	accepting int32
+}
+
+// setAccepting records whether the server is currently accepting new
+// requests, surfaced via /readyz.
+func (h *Handler) setAccepting(accepting bool) {
+	var v int32
+	if accepting {
+		v = 1
+	}
+	atomic.StoreInt32(&h.accepting, v)
+}
+
+func (h *Handler) isAccepting() bool {
+	return atomic.LoadInt32(&h.accepting) == 1
+}
+
+// workerBacklogDepth sums the in-memory worker channels across every
+// endpoint. This is worker-channel saturation, not the durable on-disk
+// backlog: it is bounded by HTTP.Concurrency times the number of endpoints
+// and says nothing about how
+// much is queued to disk, since this process has no accessor into the
+// durable package's on-disk state. Configure HighWaterMark with that in
+// mind — it trips on in-flight buffering pressure, not total backlog.
+func (h *Handler) workerBacklogDepth() int {
+	depth := 0
+	for _, endpoint := range h.Endpoints {
+		depth += len(endpoint.WorkerChannel)
+	}
+	return depth
+}
+
+// matches reports whether req satisfies any of the endpoint's match rules.
+func (e *Endpoint) matches(req *http.Request) bool {
+	for _, rule := range e.Matches {
+		if rule.matches(req) {
+			return true
+		}
+	}
+	return false
 }
 
 var (
@@ -37,7 +376,7 @@ var (
 		Name:    "endpoint_latency_us",
 		Help:    "Endpoint latency distributions in microseconds",
 		Buckets: prometheus.ExponentialBuckets(0.5, 1.3, 50),
-	}, []string{"endpoint"})
+	}, []string{"endpoint", "host"})
 
 	endpointRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "endpoint_requests",
@@ -47,6 +386,26 @@ var (
 	endpointFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "endpoint_failures",
 		Help: "Number of failed requests",
+	}, []string{"endpoint", "host"})
+
+	endpointHostState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_host_state",
+		Help: "Circuit breaker state per host (0=closed, 1=half-open, 2=open)",
+	}, []string{"endpoint", "host"})
+
+	endpointHostHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_host_healthy",
+		Help: "Whether a host last passed its active health check (1=healthy, 0=unhealthy)",
+	}, []string{"endpoint", "host"})
+
+	endpointRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "endpoint_rate_limited_total",
+		Help: "Number of outbound requests delayed by the per-endpoint rate limiter",
+	}, []string{"endpoint"})
+
+	endpointRateLimitTokens = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_rate_limit_tokens",
+		Help: "Current available tokens in the per-endpoint rate limiter bucket",
 	}, []string{"endpoint"})
 
 	requests = prometheus.NewCounter(prometheus.CounterOpts{
@@ -58,66 +417,340 @@ var (
 		Name: "failures",
 		Help: "Number of incoming failed requests",
 	})
+
+	unmatchedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "unmatched_requests",
+		Help: "Number of requests that matched no endpoint under host routing",
+	})
 )
 
-// HTTPWorker handles making the remote HTTP calls with a bounded channel concurrency
-func HTTPWorker(endpoint *Endpoint) {
-	var count int
-	var sizeEndpoints = len(endpoint.Hosts)
-	var microInNS = time.Microsecond.Nanoseconds()
+// nextAvailableHost walks the pool starting at count, skipping hosts whose
+// circuit is open or that are failing active health checks, and returns the
+// index and host of the first one found.
+func nextAvailableHost(endpoint *Endpoint, count int) (int, string, *hostState) {
+	sizeEndpoints := len(endpoint.Hosts)
+	for i := 0; i < sizeEndpoints; i++ {
+		idx := (count + i) % sizeEndpoints
+		if atomic.LoadInt32(endpoint.Healthy[idx]) == 0 {
+			continue
+		}
+		state := endpoint.HostStates[idx]
+		if state.isAvailable(endpoint.Name, endpoint.Hosts[idx]) {
+			return idx, endpoint.Hosts[idx], state
+		}
+	}
+	return 0, "", nil
+}
+
+// anyHostHealthy reports whether at least one host in the pool last passed
+// its active health check.
+func anyHostHealthy(endpoint *Endpoint) bool {
+	for _, healthy := range endpoint.Healthy {
+		if atomic.LoadInt32(healthy) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForHealthyHost blocks until at least one host in the pool is healthy,
+// returning false instead if endpoint.Done closes first so a shutdown is
+// never stuck waiting on a dead upstream. It is used to implement the
+// "hold" failure policy so the durable queue is not pounded with writes
+// while every upstream is down.
+func waitForHealthyHost(endpoint *Endpoint) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !anyHostHealthy(endpoint) {
+		select {
+		case <-endpoint.Done:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// doneContext returns a context that is canceled as soon as done closes,
+// letting blocking calls such as the rate limiter's Wait be interrupted
+// by endpoint shutdown. Callers must call the returned cancel func once
+// they are done waiting, or the watcher goroutine leaks until shutdown.
+func doneContext(done chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// probeHost issues a single health check request against host and reports
+// whether it returned an acceptable status.
+func probeHost(client *http.Client, host string, check HealthCheckConfig) bool {
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s%s", host, check.Path), nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	return check.accepts(res.StatusCode)
+}
+
+// HealthChecker periodically probes every host in endpoint.Hosts and keeps
+// endpoint.Healthy up to date, quarantining hosts that fail their probe so
+// HTTPWorker's round-robin skips them.
+func HealthChecker(endpoint *Endpoint) {
+	if endpoint.HealthCheck.Interval <= 0 {
+		return
+	}
 
-	defaultRoundTripper := http.DefaultTransport
-	defaultTransport := defaultRoundTripper.(*http.Transport)
-	defaultTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // ignore expired SSL certificates
-	client := &http.Client{Timeout: endpoint.Timeout, Transport: defaultTransport}
+	connectTimeout := endpoint.HealthCheck.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultHealthCheckTimeout
+	}
+	client := &http.Client{Timeout: connectTimeout}
 
+	probeAll := func() {
+		for i, host := range endpoint.Hosts {
+			healthy := probeHost(client, host, endpoint.HealthCheck)
+
+			var healthyVal int32
+			if healthy {
+				healthyVal = 1
+			}
+
+			if atomic.SwapInt32(endpoint.Healthy[i], healthyVal) != healthyVal {
+				log.Infof("endpoint (%s) host [%s] health check transitioned: healthy=%v", endpoint.Name, host, healthy)
+			}
+			endpointHostHealthy.WithLabelValues(endpoint.Name, host).Set(float64(healthyVal))
+		}
+	}
+
+	probeAll()
+
+	ticker := time.NewTicker(endpoint.HealthCheck.Interval)
+	defer ticker.Stop()
 	for {
-		req := <-endpoint.WorkerChannel
+		select {
+		case <-endpoint.Done:
+			return
+		case <-ticker.C:
+			probeAll()
+		}
+	}
+}
+
+// sendWithRetries attempts delivery across the host pool, rotating count
+// only on success so a dead host does not soak up round-robin slots. It
+// returns true once the request has been delivered.
+func sendWithRetries(endpoint *Endpoint, client *http.Client, req *durable.Request, count *int) bool {
+	attempts := endpoint.Retries
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	microInNS := time.Microsecond.Nanoseconds()
+	var lastErr error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		idx, host, state := nextAvailableHost(endpoint, *count+attempt)
+		if host == "" {
+			log.Debugf("endpoint (%s) has no healthy hosts available", endpoint.Name)
+			break
+		}
+
 		r := bytes.NewReader(req.Body)
-		url := fmt.Sprintf("%s%s", endpoint.Hosts[count%sizeEndpoints], req.URL)
-		proxyReq, err := http.NewRequest(req.Method, url, r)
+		reqURL := fmt.Sprintf("%s%s", host, req.URL)
+		proxyReq, err := http.NewRequest(req.Method, reqURL, r)
 		if err != nil {
 			log.Debugf("error: %s", err)
+			lastErr = err
 			continue
 		}
 
+		if endpoint.Limiter != nil {
+			if !endpoint.Limiter.Allow() {
+				endpointRateLimited.WithLabelValues(endpoint.Name).Inc()
+				waitCtx, cancel := doneContext(endpoint.Done)
+				err := endpoint.Limiter.Wait(waitCtx)
+				cancel()
+				if err != nil {
+					log.Debugf("error waiting on rate limiter: %s", err)
+				}
+			}
+			endpointRateLimitTokens.WithLabelValues(endpoint.Name).Set(endpoint.Limiter.Tokens())
+		}
+
 		start := time.Now()
 		endpointRequests.WithLabelValues(endpoint.Name).Inc()
 		proxyRes, err := client.Do(proxyReq)
 
 		respLatencyNS := time.Since(start).Nanoseconds()
-		elasped := float64(respLatencyNS / microInNS)
-		endpointLatencyHistogram.WithLabelValues(endpoint.Name).Observe(elasped)
+		elapsed := float64(respLatencyNS / microInNS)
+		endpointLatencyHistogram.WithLabelValues(endpoint.Name, host).Observe(elapsed)
+
+		if err == nil && proxyRes.StatusCode >= 500 {
+			io.Copy(ioutil.Discard, proxyRes.Body)
+			proxyRes.Body.Close()
+			err = fmt.Errorf("received %d from %s", proxyRes.StatusCode, host)
+		}
 
 		if err != nil {
-			endpointFailures.WithLabelValues(endpoint.Name).Inc()
+			lastErr = err
+			endpointFailures.WithLabelValues(endpoint.Name, host).Inc()
+			state.recordFailure(endpoint.Name, host, endpoint.FailureThreshold, endpoint.CooldownWindow)
 			log.Debugf("error: %s", err)
-			endpoint.Writer <- req
+
+			if attempt < attempts-1 {
+				select {
+				case <-time.After(backoffDelay(endpoint.Delay, attempt)):
+				case <-endpoint.Done:
+					log.Debugf("endpoint (%s) shutting down mid-backoff, surrendering request", endpoint.Name)
+					return false
+				}
+			}
 			continue
 		}
 
 		io.Copy(ioutil.Discard, proxyRes.Body)
 		proxyRes.Body.Close()
+		state.recordSuccess(endpoint.Name, host)
+		*count = idx + 1
+		return true
+	}
+
+	log.Debugf("endpoint (%s) exhausted all retries: %v", endpoint.Name, lastErr)
+	return false
+}
+
+// HTTPWorker handles making the remote HTTP calls with a bounded channel concurrency
+func HTTPWorker(endpoint *Endpoint) {
+	defer endpoint.WG.Done()
+
+	var count int
+	client := &http.Client{Timeout: endpoint.Timeout, Transport: endpoint.Transport}
+
+	for {
+		select {
+		case <-endpoint.Done:
+			drainWorkerChannel(endpoint)
+			return
+		case req := <-endpoint.WorkerChannel:
+			if endpoint.HealthCheck.Interval > 0 && !anyHostHealthy(endpoint) {
+				if endpoint.HealthCheck.FailurePolicy == failurePolicyHold {
+					if !waitForHealthyHost(endpoint) {
+						// shutting down: surrender rather than block past endpoint.Done
+						endpoint.Writer <- req
+						continue
+					}
+				} else {
+					log.Debugf("endpoint (%s) has no healthy hosts, failing fast to durable queue", endpoint.Name)
+					endpoint.Writer <- req
+					continue
+				}
+			}
+
+			if !sendWithRetries(endpoint, client, req, &count) {
+				// all retries across all hosts exhausted, surrender back to the durable queue
+				endpoint.Writer <- req
+			}
+		}
+	}
+}
+
+// drainWorkerChannel flushes any requests still sitting in the worker
+// channel back onto the durable queue so a shutdown never drops data.
+func drainWorkerChannel(endpoint *Endpoint) {
+	for {
+		select {
+		case req := <-endpoint.WorkerChannel:
+			endpoint.Writer <- req
+		default:
+			return
+		}
 	}
 }
 
 // ReadDiskChannel handles reading from the disk backed channel
 func ReadDiskChannel(endpoint *Endpoint) {
+	defer endpoint.WG.Done()
+
 	var count int
 	for {
-		item := <-endpoint.DurableChannel
-		req := item.(durable.Request)
-		count++
+		select {
+		case <-endpoint.Done:
+			return
+		case item := <-endpoint.DurableChannel:
+			req := item.(durable.Request)
+			count++
+
+			if count%1000 == 0 {
+				log.Debug("processed 1000 operations")
+			}
 
-		if count%1000 == 0 {
-			log.Debug("processed 1000 operations")
+			select {
+			case endpoint.WorkerChannel <- &req:
+			case <-endpoint.Done:
+				// already pulled off disk, don't lose it on the way to the worker channel
+				endpoint.Writer <- &req
+				return
+			}
 		}
-		endpoint.WorkerChannel <- &req
 	}
 }
 
+// HandleHealthz reports whether the process is alive, independent of
+// whether it is currently accepting new requests.
+func (h *Handler) HandleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleReadyz reports whether the server is still accepting new requests
+// and whether its worker channels are under the configured high-water
+// mark. Note this does not see the durable on-disk backlog, only
+// in-memory buffering pressure; see workerBacklogDepth.
+func (h *Handler) HandleReadyz(w http.ResponseWriter, req *http.Request) {
+	if !h.isAccepting() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.HighWaterMark > 0 && h.workerBacklogDepth() >= h.HighWaterMark {
+		http.Error(w, "worker backlog above high water mark", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // HandleRequest handles processing every request sent
 func (h *Handler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	if h.InboundLimiter != nil && !h.InboundLimiter.Allow() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if h.HighWaterMark > 0 && h.workerBacklogDepth() >= h.HighWaterMark {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "worker backlog exceeded high water mark", http.StatusTooManyRequests)
+		return
+	}
+
 	requests.Inc()
 	body, err := ioutil.ReadAll(req.Body)
 	defer req.Body.Close()
@@ -130,16 +763,35 @@ func (h *Handler) HandleRequest(w http.ResponseWriter, req *http.Request) {
 	}
 
 	r := &durable.Request{Method: req.Method, URL: req.URL.String(), Body: body}
-	for _, endpoint := range h.Endpoints {
-		endpoint.Writer <- r
+
+	if h.Routing == routingHost {
+		matched := false
+		for _, endpoint := range h.Endpoints {
+			if endpoint.matches(req) {
+				endpoint.Writer <- r
+				matched = true
+			}
+		}
+		if !matched {
+			unmatchedRequests.Inc()
+			http.Error(w, "no endpoint matched", http.StatusNotFound)
+			return
+		}
+	} else {
+		for _, endpoint := range h.Endpoints {
+			endpoint.Writer <- r
+		}
 	}
 
 	// 200 - StatusNoContent
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// ListenAndServe will startup an http server and handle proxying requests
-func ListenAndServe(config *Config, addr string, dataDir string) {
+// ListenAndServe will startup an http server and handle proxying requests.
+// It blocks until ctx is cancelled or SIGINT/SIGTERM is received, at which
+// point it stops accepting new connections and drains every endpoint's
+// in-flight requests back onto the durable queue before returning.
+func ListenAndServe(ctx context.Context, config *Config, addr string, dataDir string) {
 	var ep []Endpoint
 	var timeout = config.HTTP.Timeout
 	var maxMsgSize = config.Queue.MaxMessageSize
@@ -165,8 +817,24 @@ func ListenAndServe(config *Config, addr string, dataDir string) {
 		}
 	}
 
+	routing := config.Routing
+	if routing == "" {
+		routing = routingFanout
+	}
+	log.Infof("routing mode: %s", routing)
+
 	// register prometheus metrics
-	prometheus.MustRegister(requests, failures, endpointLatencyHistogram, endpointRequests, endpointFailures)
+	prometheus.MustRegister(requests, failures, unmatchedRequests, endpointLatencyHistogram, endpointRequests,
+		endpointFailures, endpointHostState, endpointHostHealthy, endpointRateLimited, endpointRateLimitTokens)
+
+	var inboundLimiter *rate.Limiter
+	if config.HTTP.RateLimit.RequestsPerSecond > 0 {
+		burst := config.HTTP.RateLimit.Burst
+		if burst == 0 {
+			burst = int(config.HTTP.RateLimit.RequestsPerSecond)
+		}
+		inboundLimiter = rate.NewLimiter(rate.Limit(config.HTTP.RateLimit.RequestsPerSecond), burst)
+	}
 
 	for _, endpoint := range config.Endpoints {
 		for _, host := range endpoint.Hosts {
@@ -175,11 +843,36 @@ func ListenAndServe(config *Config, addr string, dataDir string) {
 			}
 		}
 
+		endpointTimeout := endpoint.Timeout
+		if endpointTimeout.Seconds() == 0.0 {
+			endpointTimeout = timeout
+		}
+
+		// Default retries to the size of the host pool so failover across
+		// every configured host works out of the box without the operator
+		// having to opt in.
+		retries := endpoint.Retries
+		if retries == 0 {
+			retries = len(endpoint.Hosts)
+		}
+
+		failureThreshold := endpoint.FailureThreshold
+		if failureThreshold == 0 {
+			failureThreshold = defaultFailureThreshold
+		}
+
+		cooldownWindow := endpoint.CooldownWindow
+		if cooldownWindow.Seconds() == 0.0 {
+			cooldownWindow = defaultCooldownWindow
+		}
+
 		log.Infof("registered (%s) with endpoints: [%s]", endpoint.Name, strings.Join(endpoint.Hosts, ","))
-		log.Infof("config options: (http timeout: %s, maxMsgSize: %d, concurrency: %d)",
-			timeout,
+		log.Infof("config options: (http timeout: %s, maxMsgSize: %d, concurrency: %d, retries: %d, delay: %s)",
+			endpointTimeout,
 			maxMsgSize,
-			concurrency)
+			concurrency,
+			retries,
+			endpoint.Delay)
 
 		writer := make(chan interface{})
 		worker := make(chan *durable.Request, concurrency)
@@ -194,30 +887,197 @@ func ListenAndServe(config *Config, addr string, dataDir string) {
 			SyncTimeout:     time.Second * 10,
 		})
 
+		hostStates := make([]*hostState, len(endpoint.Hosts))
+		healthy := make([]*int32, len(endpoint.Hosts))
+		for i, host := range endpoint.Hosts {
+			hostStates[i] = &hostState{}
+			endpointHostState.WithLabelValues(endpoint.Name, host).Set(hostStateClosed)
+
+			healthy[i] = new(int32)
+			atomic.StoreInt32(healthy[i], 1)
+			endpointHostHealthy.WithLabelValues(endpoint.Name, host).Set(1)
+		}
+
+		failurePolicy := endpoint.HealthCheck.FailurePolicy
+		if failurePolicy == "" {
+			failurePolicy = failurePolicyFailFast
+		}
+
+		var limiter *rate.Limiter
+		if endpoint.Rate.RequestsPerSecond > 0 {
+			burst := endpoint.Rate.Burst
+			if burst == 0 {
+				burst = int(endpoint.Rate.RequestsPerSecond)
+				if burst < 1 {
+					// a zero burst makes Wait fail at once, leaving calls unthrottled
+					burst = 1
+				}
+			}
+			limiter = rate.NewLimiter(rate.Limit(endpoint.Rate.RequestsPerSecond), burst)
+			endpointRateLimitTokens.WithLabelValues(endpoint.Name).Set(limiter.Tokens())
+		}
+
+		matches := make([]matchRule, len(endpoint.Match))
+		for i, m := range endpoint.Match {
+			matches[i] = matchRule{
+				HostGlob:    m.Host,
+				PathPrefix:  m.Path,
+				Header:      m.Header,
+				HeaderValue: m.Value,
+			}
+		}
+
+		transport, err := buildTransport(TransportConfig{
+			RootCAFile:          endpoint.Transport.RootCAFile,
+			ClientCertFile:      endpoint.Transport.ClientCertFile,
+			ClientKeyFile:       endpoint.Transport.ClientKeyFile,
+			InsecureSkipVerify:  endpoint.Transport.InsecureSkipVerify,
+			DisableHTTP2:        endpoint.Transport.DisableHTTP2,
+			MaxIdleConns:        endpoint.Transport.MaxIdleConns,
+			MaxIdleConnsPerHost: endpoint.Transport.MaxIdleConnsPerHost,
+			IdleConnTimeout:     endpoint.Transport.IdleConnTimeout,
+			KeepAlive:           endpoint.Transport.KeepAlive,
+		})
+		if err != nil {
+			log.Fatalf("(%s) invalid transport config: %s", endpoint.Name, err)
+		}
+
+		var wg sync.WaitGroup
+
 		e := &Endpoint{
-			Name:           endpoint.Name,
-			Hosts:          endpoint.Hosts,
-			Writer:         writer,
-			DurableChannel: c,
-			WorkerChannel:  worker,
-			Timeout:        timeout,
+			Name:             endpoint.Name,
+			Hosts:            endpoint.Hosts,
+			HostStates:       hostStates,
+			Healthy:          healthy,
+			Writer:           writer,
+			DurableChannel:   c,
+			WorkerChannel:    worker,
+			Timeout:          endpointTimeout,
+			Retries:          retries,
+			Delay:            endpoint.Delay,
+			FailureThreshold: failureThreshold,
+			CooldownWindow:   cooldownWindow,
+			HealthCheck: HealthCheckConfig{
+				Path:           endpoint.HealthCheck.Path,
+				Method:         endpoint.HealthCheck.Method,
+				Interval:       endpoint.HealthCheck.Interval,
+				ConnectTimeout: endpoint.HealthCheck.ConnectTimeout,
+				ExpectedStatus: endpoint.HealthCheck.ExpectedStatus,
+				FailurePolicy:  failurePolicy,
+			},
+			Matches:   matches,
+			Limiter:   limiter,
+			Transport: transport,
+			Done:      make(chan struct{}),
+			WG:        &wg,
 		}
 		ep = append(ep, *e)
 
+		wg.Add(concurrency + 1) // HTTPWorker pool + ReadDiskChannel
 		for i := 0; i < concurrency; i++ {
 			go HTTPWorker(e)
 		}
 
 		go ReadDiskChannel(e)
+		go HealthChecker(e)
 
 	}
 
-	handler := &Handler{Endpoints: ep}
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", handler.HandleRequest)
+	handler := &Handler{
+		Endpoints:      ep,
+		Routing:        routing,
+		InboundLimiter: inboundLimiter,
+		HighWaterMark:  config.Queue.HighWaterMark,
+	}
+	handler.setAccepting(true)
+
+	fullMux := http.NewServeMux()
+	fullMux.Handle("/metrics", promhttp.Handler())
+	fullMux.HandleFunc("/healthz", handler.HandleHealthz)
+	fullMux.HandleFunc("/readyz", handler.HandleReadyz)
+	// Mounted explicitly since these listeners no longer serve
+	// http.DefaultServeMux, which is all the blank pprof import used to
+	// register against.
+	fullMux.HandleFunc("/debug/pprof/", pprof.Index)
+	fullMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	fullMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	fullMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	fullMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	fullMux.HandleFunc("/", handler.HandleRequest)
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.HandleFunc("/healthz", handler.HandleHealthz)
+
+	listeners, err := buildListenerConfigs(config, addr)
+	if err != nil {
+		log.Fatalf("invalid listener config: %s", err)
+	}
+
+	servers := make([]*http.Server, len(listeners))
+	serverErrCh := make(chan error, len(listeners))
+	var serverWG sync.WaitGroup
+
+	for i, lc := range listeners {
+		mux := fullMux
+		if lc.MetricsOnly {
+			mux = metricsMux
+		}
+
+		server := &http.Server{Addr: lc.Addr, Handler: mux, TLSConfig: lc.TLSConfig}
+		servers[i] = server
+
+		serverWG.Add(1)
+		go func(server *http.Server) {
+			defer serverWG.Done()
+
+			var err error
+			if server.TLSConfig != nil {
+				log.Printf("listening on %s (tls)", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("listening on %s", server.Addr)
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				serverErrCh <- err
+			}
+		}(server)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case <-ctx.Done():
+		log.Info("context cancelled, shutting down")
+	case sig := <-sigCh:
+		log.Infof("received signal %s, shutting down", sig)
+	case err := <-serverErrCh:
+		log.Fatal(err)
+		return
+	}
+
+	handler.setAccepting(false)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("error shutting down http server on %s: %s", server.Addr, err)
+		}
+	}
+	serverWG.Wait()
+
+	for _, endpoint := range ep {
+		close(endpoint.Done)
+	}
+	for _, endpoint := range ep {
+		endpoint.WG.Wait()
+	}
 
-	log.Printf("listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Info("shutdown complete, durable queues drained")
 }
 
 // isValidURL handles checking if a url is valid
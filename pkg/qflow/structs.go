@@ -9,12 +9,116 @@ import (
 
 type Config struct {
 	HTTP struct {
-		Timeout time.Duration `yaml:"timeout"`
+		Timeout     time.Duration `yaml:"timeout"`
+		Concurrency int           `yaml:"concurrency"`
+
+		// RateLimit throttles inbound requests before they are ever
+		// buffered to disk, returning 429 once exhausted.
+		RateLimit struct {
+			RequestsPerSecond float64 `yaml:"requests_per_second"`
+			Burst             int     `yaml:"burst"`
+		} `yaml:"rate_limit"`
+
+		// Listeners lists every address qflow should bind. When empty,
+		// ListenAndServe falls back to the addr it was called with.
+		Listeners []struct {
+			Addr string `yaml:"addr"`
+			// MetricsOnly restricts this listener to /metrics and
+			// /healthz, for binding an internal-only admin port.
+			MetricsOnly bool `yaml:"metrics_only"`
+			TLS         struct {
+				CertFile     string `yaml:"cert_file"`
+				KeyFile      string `yaml:"key_file"`
+				ClientCAFile string `yaml:"client_ca_file"` // enables mTLS when set
+			} `yaml:"tls"`
+		} `yaml:"listeners"`
 	}
 
+	Queue struct {
+		MaxMessageSize int `yaml:"max_message_size"`
+		// HighWaterMark is the number of in-flight items allowed to sit
+		// in the worker channels, summed across every endpoint, before
+		// inbound requests are rejected with 429 rather than buffered to
+		// the durable queue. It bounds in-memory worker saturation, not
+		// the durable on-disk backlog, so it is only meaningful set at or
+		// below HTTP.Concurrency times the number of endpoints.
+		HighWaterMark int `yaml:"high_water_mark"`
+	}
+
+	// Routing selects how inbound requests are dispatched to endpoints:
+	// "fanout" (default) sends every request to every endpoint, "host"
+	// dispatches only to endpoints whose Match rules are satisfied.
+	Routing string `yaml:"routing"`
+
 	Endpoints []struct {
 		Name  string   `yaml:"name"`
 		Hosts []string `yaml:"hosts"`
+
+		// Retries is the total number of attempts (across hosts) made
+		// before a request is surrendered back to the durable queue.
+		// Defaults to the size of Hosts, so failover across the whole
+		// pool happens without explicit configuration.
+		Retries int `yaml:"retries"`
+		// Delay is the base backoff between attempts; jitter is added
+		// and the delay doubles on each successive attempt.
+		Delay time.Duration `yaml:"delay"`
+		// Timeout overrides HTTP.Timeout on a per-endpoint basis.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// FailureThreshold is the number of consecutive failures on a
+		// host before its circuit is tripped open.
+		FailureThreshold int `yaml:"failure_threshold"`
+		// CooldownWindow is how long a host is skipped once its
+		// circuit is open before it is probed again.
+		CooldownWindow time.Duration `yaml:"cooldown_window"`
+
+		// Rate throttles outbound calls for this endpoint so a slow
+		// upstream cannot be overwhelmed by a burst drained from the
+		// durable queue.
+		Rate struct {
+			RequestsPerSecond float64 `yaml:"requests_per_second"`
+			Burst             int     `yaml:"burst"`
+		} `yaml:"rate"`
+
+		// Transport configures the outbound http.Transport used to
+		// reach this endpoint's hosts. InsecureSkipVerify must be
+		// opted into per endpoint rather than assumed globally.
+		Transport struct {
+			RootCAFile          string        `yaml:"root_ca_file"`
+			ClientCertFile      string        `yaml:"client_cert_file"`
+			ClientKeyFile       string        `yaml:"client_key_file"`
+			InsecureSkipVerify  bool          `yaml:"insecure_skip_verify"`
+			DisableHTTP2        bool          `yaml:"disable_http2"`
+			MaxIdleConns        int           `yaml:"max_idle_conns"`
+			MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+			IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+			KeepAlive           time.Duration `yaml:"keep_alive"`
+		} `yaml:"transport"`
+
+		// HealthCheck configures active probing of this endpoint's
+		// hosts. Leave Interval unset to disable health checking.
+		HealthCheck struct {
+			Path           string        `yaml:"path"`
+			Method         string        `yaml:"method"`
+			Interval       time.Duration `yaml:"interval"`
+			ConnectTimeout time.Duration `yaml:"connect_timeout"`
+			ExpectedStatus []int         `yaml:"expected_status"`
+			// FailurePolicy controls what happens when every host is
+			// unhealthy: "fail-fast" (default) surrenders the request
+			// to the durable queue immediately, "hold" blocks the
+			// worker until a host recovers.
+			FailurePolicy string `yaml:"failure_policy"`
+		} `yaml:"health_check"`
+
+		// Match rules are only consulted when Routing is "host". An
+		// endpoint is dispatched to when any one of its rules is
+		// satisfied; within a rule, every non-empty predicate must match.
+		Match []struct {
+			Host   string `yaml:"host"`
+			Path   string `yaml:"path"`
+			Header string `yaml:"header"`
+			Value  string `yaml:"value"`
+		} `yaml:"match"`
 	}
 }
 
@@ -32,4 +136,4 @@ func ParseConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	return &config, nil
-}
\ No newline at end of file
+}